@@ -24,14 +24,30 @@ import (
 	"strings"
 )
 
-// Decoder that expects a single StatsD-formatted string in the message payload.
-// Breaks the message into Fields for Metric, Value, Modifier and Sampling.
+// Decoder that expects a single StatsD-formatted string in the message
+// payload. Breaks the message into Fields for Metric, Value, Modifier and
+// Sampling. Also understands the DogStatsD dialect used by Telegraf and
+// other modern statsd receivers, which appends a `#tag1:val1,tag2:val2`
+// section and the `h`/`d` (histogram/distribution) modifiers.
 type StatsdDecoder struct {
 	runner DecoderRunner
 	helper PluginHelper
+	config *StatsdDecoderConfig
+}
+
+type StatsdDecoderConfig struct {
+	// Prefix for any Fields derived from DogStatsD tags
+	TagNamePrefix string `toml:"tagname_prefix"`
+	// Recognize the DogStatsD `#tag:val,...` section and `h`/`d` modifiers
+	AllowDogstatsd bool `toml:"allow_dogstatsd"`
+}
+
+func (d *StatsdDecoder) ConfigStruct() interface{} {
+	return &StatsdDecoderConfig{}
 }
 
 func (d *StatsdDecoder) Init(config interface{}) error {
+	d.config = config.(*StatsdDecoderConfig)
 	return nil
 }
 
@@ -60,13 +76,13 @@ func (d *StatsdDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err e
 		return
 	}
 
-	// look for pipes - some types have 3 pipes
-	parts = strings.SplitN(parts[1], "|", 3)
-	if len(parts) < 2 {
+	// look for pipes - some types have 3 pipes, DogStatsD can have more
+	pipeParts := strings.Split(parts[1], "|")
+	if len(pipeParts) < 2 {
 		err = fmt.Errorf("not enough pipes: '%s'", line)
 		return
 	}
-	value, err := strconv.ParseFloat(parts[0], 64)
+	value, err := strconv.ParseFloat(pipeParts[0], 64)
 	if err != nil {
 		err = fmt.Errorf("invalid value: '%s'", line)
 		return
@@ -76,29 +92,54 @@ func (d *StatsdDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err e
 	}
 
 	// check for valid modifiers
-	switch parts[1] {
+	switch pipeParts[1] {
 	case "g", "c", "ms", "s":
-		if err = d.addStatField(pack, "Modifier", parts[1]); err != nil {
+	case "h", "d":
+		if !d.config.AllowDogstatsd {
+			err = fmt.Errorf("unknown metric type: '%s'", line)
 			return
 		}
 	default:
 		err = fmt.Errorf("unknown metric type: '%s'", line)
 		return
 	}
+	if err = d.addStatField(pack, "Modifier", pipeParts[1]); err != nil {
+		return
+	}
 
-	// add a @samplerate if it was given, otherwise default to 1
+	// the remaining pipe-delimited sections may carry a @rate and, for
+	// DogStatsD, a #-prefixed tag section, in any order
 	rate := float64(1)
-	if len(parts) == 3 && strings.HasPrefix(parts[2], "@") {
-		rate, err = strconv.ParseFloat(parts[2][1:], 32)
-		if err != nil {
-			fmt.Errorf("coudn't parse sample rate: '%s'", line)
-			return
+	var tagSection string
+	for _, extra := range pipeParts[2:] {
+		switch {
+		case strings.HasPrefix(extra, "@"):
+			if rate, err = strconv.ParseFloat(extra[1:], 64); err != nil {
+				err = fmt.Errorf("coudn't parse sample rate: '%s'", line)
+				return
+			}
+		case d.config.AllowDogstatsd && strings.HasPrefix(extra, "#"):
+			tagSection = extra[1:]
 		}
 	}
 	if err = d.addStatField(pack, "Sampling", rate); err != nil {
 		return
 	}
 
+	// emit DogStatsD tags as fields, named with the configurable prefix so
+	// OpenTsdbRawEncoder's FieldsToTags picks them up
+	if tagSection != "" {
+		for _, tag := range strings.Split(tagSection, ",") {
+			kv := strings.SplitN(tag, ":", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				continue
+			}
+			if err = d.addStatField(pack, d.config.TagNamePrefix+kv[0], kv[1]); err != nil {
+				return
+			}
+		}
+	}
+
 	pack.Message.SetType("statsd")
 	packs = []*PipelinePack{pack}
 	return
@@ -0,0 +1,124 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2012
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"testing"
+)
+
+func decodeLine(t *testing.T, cfg *StatsdDecoderConfig, line string) (*pipeline.PipelinePack, error) {
+	t.Helper()
+
+	d := new(StatsdDecoder)
+	if err := d.Init(cfg); err != nil {
+		t.Fatalf("Init() returned error: %s", err)
+	}
+
+	pack := &pipeline.PipelinePack{Message: new(message.Message)}
+	pack.Message.SetPayload(line)
+
+	_, err := d.Decode(pack)
+	return pack, err
+}
+
+func fieldValue(t *testing.T, pack *pipeline.PipelinePack, name string) interface{} {
+	t.Helper()
+	v, ok := pack.Message.GetFieldValue(name)
+	if !ok {
+		t.Fatalf("expected field %q to be set", name)
+	}
+	return v
+}
+
+func TestDecodeLegacyCounter(t *testing.T) {
+	pack, err := decodeLine(t, &StatsdDecoderConfig{}, "gorets:1|c")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := fieldValue(t, pack, "Metric"); v != "gorets" {
+		t.Errorf("Metric = %v, want 'gorets'", v)
+	}
+	if v := fieldValue(t, pack, "Value"); v != 1.0 {
+		t.Errorf("Value = %v, want 1", v)
+	}
+	if v := fieldValue(t, pack, "Modifier"); v != "c" {
+		t.Errorf("Modifier = %v, want 'c'", v)
+	}
+	if v := fieldValue(t, pack, "Sampling"); v != 1.0 {
+		t.Errorf("Sampling = %v, want 1", v)
+	}
+}
+
+func TestDecodeLegacySampleRate(t *testing.T) {
+	pack, err := decodeLine(t, &StatsdDecoderConfig{}, "gorets:1|c|@0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := fieldValue(t, pack, "Sampling"); v != 0.1 {
+		t.Errorf("Sampling = %v, want 0.1", v)
+	}
+}
+
+func TestDecodeRejectsHistogramWhenDogstatsdDisabled(t *testing.T) {
+	_, err := decodeLine(t, &StatsdDecoderConfig{}, "gorets:1|h")
+	if err == nil {
+		t.Fatalf("expected an error decoding an 'h' metric with AllowDogstatsd=false")
+	}
+}
+
+func TestDecodeDogstatsdHistogramWithTagsAndRate(t *testing.T) {
+	cfg := &StatsdDecoderConfig{AllowDogstatsd: true, TagNamePrefix: "tag_"}
+	pack, err := decodeLine(t, cfg, "request.latency:42.5|h|@0.5|#env:prod,host:web1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := fieldValue(t, pack, "Metric"); v != "request.latency" {
+		t.Errorf("Metric = %v, want 'request.latency'", v)
+	}
+	if v := fieldValue(t, pack, "Value"); v != 42.5 {
+		t.Errorf("Value = %v, want 42.5", v)
+	}
+	if v := fieldValue(t, pack, "Modifier"); v != "h" {
+		t.Errorf("Modifier = %v, want 'h'", v)
+	}
+	if v := fieldValue(t, pack, "Sampling"); v != 0.5 {
+		t.Errorf("Sampling = %v, want 0.5", v)
+	}
+	if v := fieldValue(t, pack, "tag_env"); v != "prod" {
+		t.Errorf("tag_env = %v, want 'prod'", v)
+	}
+	if v := fieldValue(t, pack, "tag_host"); v != "web1" {
+		t.Errorf("tag_host = %v, want 'web1'", v)
+	}
+}
+
+func TestDecodeDogstatsdTagsOrderIndependentOfRate(t *testing.T) {
+	cfg := &StatsdDecoderConfig{AllowDogstatsd: true, TagNamePrefix: "tag_"}
+	pack, err := decodeLine(t, cfg, "request.count:1|d|#env:prod|@0.25")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v := fieldValue(t, pack, "Modifier"); v != "d" {
+		t.Errorf("Modifier = %v, want 'd'", v)
+	}
+	if v := fieldValue(t, pack, "Sampling"); v != 0.25 {
+		t.Errorf("Sampling = %v, want 0.25", v)
+	}
+	if v := fieldValue(t, pack, "tag_env"); v != "prod" {
+		t.Errorf("tag_env = %v, want 'prod'", v)
+	}
+}
@@ -0,0 +1,164 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package influxdb holds encoders that target InfluxDB.
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hynd/heka-tsutils-plugins/internal/tagutil"
+	"github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxLineEncoder generates InfluxDB line protocol, reusing the same
+// embedded-tag extraction as OpenTsdbRawEncoder so the two encoders stay
+// in sync with each other.
+type InfluxLineEncoder struct {
+	config       *InfluxLineEncoderConfig
+	missingTags  map[string]string
+	overrideTags map[string]string
+}
+
+type InfluxLineEncoderConfig struct {
+	// Field key the metric value is written under, defaults to 'value'
+	ValueField string `toml:"value_field"`
+	// String to demarcate embedded tag keys in the metric name
+	TagNamePrefix string `toml:"tagname_prefix"`
+	// String to demarcate embedded tag values in the metric name, defaults to '.'
+	TagValuePrefix string `toml:"tagvalue_prefix"`
+	// Base metric timestamp on either message Timestamp or "now"
+	TsFromMessage bool `toml:"ts_from_message"`
+	// Add any Fields with TagNamePrefix as tags
+	FieldsToTags bool `toml:"fields_to_tags"`
+	// Array of static tags to add if missing
+	AddTagsIfMissing []string `toml:"tags_if_missing"`
+	// Array of static tags to override unconditionally
+	AddTagsOverride []string `toml:"tags_override"`
+}
+
+func (ie *InfluxLineEncoder) ConfigStruct() interface{} {
+	return &InfluxLineEncoderConfig{
+		ValueField:    "value",
+		TsFromMessage: true,
+		FieldsToTags:  true,
+	}
+}
+
+func (ie *InfluxLineEncoder) Init(config interface{}) (err error) {
+	ie.config = config.(*InfluxLineEncoderConfig)
+	// We need to split a value from the key somehow, default to '.'
+	if ie.config.TagNamePrefix != "" && ie.config.TagValuePrefix == "" {
+		ie.config.TagValuePrefix = "."
+	}
+
+	ie.missingTags = tagutil.ParseStaticTags(ie.config.AddTagsIfMissing)
+	ie.overrideTags = tagutil.ParseStaticTags(ie.config.AddTagsOverride)
+
+	return
+}
+
+func (ie *InfluxLineEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+
+	buf := new(bytes.Buffer)
+
+	metric, ok := pack.Message.GetFieldValue("Metric")
+	if !ok {
+		err = fmt.Errorf("Unable to find Field[Metric] in message")
+		return nil, err
+	}
+
+	value, ok := pack.Message.GetFieldValue("Value")
+	if !ok {
+		err = fmt.Errorf("Unable to find Field[Value] field in message")
+		return nil, err
+	}
+
+	baseMetric, tagKeys, tagMap := tagutil.Extract(pack, metric.(string), tagutil.Config{
+		TagNamePrefix:  ie.config.TagNamePrefix,
+		TagValuePrefix: ie.config.TagValuePrefix,
+		FieldsToTags:   ie.config.FieldsToTags,
+		MissingTags:    ie.missingTags,
+		OverrideTags:   ie.overrideTags,
+	})
+
+	buf.WriteString(escapeKey(baseMetric))
+	for _, k := range tagKeys {
+		buf.WriteString(",")
+		buf.WriteString(escapeKey(k))
+		buf.WriteString("=")
+		buf.WriteString(escapeKey(fmt.Sprint(tagMap[k])))
+	}
+
+	buf.WriteString(" ")
+	buf.WriteString(escapeKey(ie.config.ValueField))
+	buf.WriteString("=")
+	buf.WriteString(formatValue(value))
+
+	var timestamp time.Time
+	if ie.config.TsFromMessage {
+		timestamp = time.Unix(0, pack.Message.GetTimestamp()).UTC()
+	} else {
+		timestamp = time.Now().UTC()
+	}
+	buf.WriteString(" ")
+	buf.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
+
+// escapeKey escapes spaces, commas and equals signs, which are the
+// characters the line protocol treats as structural in measurement
+// names, tag keys and tag values.
+func escapeKey(s string) string {
+	r := strings.NewReplacer(
+		`,`, `\,`,
+		`=`, `\=`,
+		` `, `\ `,
+	)
+	return r.Replace(s)
+}
+
+// formatValue renders a field as an InfluxDB line protocol field value,
+// suffixing integers with 'i' to distinguish them from floats.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i"
+	case int:
+		return strconv.Itoa(v) + "i"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+	default:
+		return fmt.Sprintf(`"%v"`, v)
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("InfluxLineEncoder", func() interface{} {
+		return new(InfluxLineEncoder)
+	})
+}
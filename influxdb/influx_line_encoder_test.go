@@ -0,0 +1,144 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package influxdb
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+	"testing"
+)
+
+func newInfluxTestPack(metric string, value interface{}, tags map[string]string, ts int64) *pipeline.PipelinePack {
+	pack := &pipeline.PipelinePack{Message: new(message.Message)}
+
+	addField := func(name string, value interface{}) {
+		field, err := message.NewField(name, value, "")
+		if err != nil {
+			panic(err)
+		}
+		pack.Message.AddField(field)
+	}
+
+	addField("Metric", metric)
+	addField("Value", value)
+	for k, v := range tags {
+		addField("tag_"+k, v)
+	}
+	pack.Message.SetTimestamp(ts)
+
+	return pack
+}
+
+func newTestEncoder(cfg *InfluxLineEncoderConfig) *InfluxLineEncoder {
+	ie := new(InfluxLineEncoder)
+	if err := ie.Init(cfg); err != nil {
+		panic(err)
+	}
+	return ie
+}
+
+func TestEncodeEscapesSpacesCommasAndEquals(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{
+		ValueField:    "value",
+		TsFromMessage: true,
+		FieldsToTags:  true,
+		TagNamePrefix: "tag_",
+	})
+
+	pack := newInfluxTestPack("page views", 1.0, map[string]string{"path": "a=b,c d"}, 1000)
+	out, err := ie.Encode(pack)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got := string(out)
+	if !strings.Contains(got, `page\ views`) {
+		t.Errorf("expected escaped measurement name, got %q", got)
+	}
+	if !strings.Contains(got, `path=a\=b\,c\ d`) {
+		t.Errorf("expected escaped tag value, got %q", got)
+	}
+}
+
+func TestEncodeFormatsIntegerValuesWithISuffix(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{ValueField: "value", TsFromMessage: true})
+
+	pack := newInfluxTestPack("requests", int64(42), nil, 1000)
+	out, err := ie.Encode(pack)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(out), "value=42i") {
+		t.Errorf("expected integer value suffixed with 'i', got %q", out)
+	}
+}
+
+func TestEncodeFormatsFloatValuesWithoutISuffix(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{ValueField: "value", TsFromMessage: true})
+
+	pack := newInfluxTestPack("latency", 42.5, nil, 1000)
+	out, err := ie.Encode(pack)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(out), "value=42.5") {
+		t.Errorf("expected unsuffixed float value, got %q", out)
+	}
+	if strings.Contains(string(out), "42.5i") {
+		t.Errorf("float value must not be suffixed with 'i', got %q", out)
+	}
+}
+
+func TestEncodeWritesTimestampFromMessageInNanoseconds(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{ValueField: "value", TsFromMessage: true})
+
+	pack := newInfluxTestPack("latency", 1.0, nil, 1234567890)
+	out, err := ie.Encode(pack)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(string(out)), "1234567890") {
+		t.Errorf("expected line to end with the message timestamp in ns, got %q", out)
+	}
+}
+
+func TestEncodeExtractsFieldTags(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{
+		ValueField:    "value",
+		TsFromMessage: true,
+		FieldsToTags:  true,
+		TagNamePrefix: "tag_",
+	})
+
+	pack := newInfluxTestPack("latency", 1.0, map[string]string{"host": "web1", "env": "prod"}, 1000)
+	out, err := ie.Encode(pack)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := string(out)
+	if !strings.Contains(got, "host=web1") || !strings.Contains(got, "env=prod") {
+		t.Errorf("expected both Field-derived tags in output, got %q", got)
+	}
+}
+
+func TestEncodeMissingMetricFieldErrors(t *testing.T) {
+	ie := newTestEncoder(&InfluxLineEncoderConfig{ValueField: "value"})
+	pack := &pipeline.PipelinePack{Message: new(message.Message)}
+
+	if _, err := ie.Encode(pack); err == nil {
+		t.Fatalf("expected an error when Metric field is missing")
+	}
+}
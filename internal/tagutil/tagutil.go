@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+// Package tagutil holds the tag-extraction logic shared by the
+// OpenTSDB and InfluxDB encoders: pulling tags out of a metric name
+// embedded with a TagNamePrefix/TagValuePrefix scheme, merging in any
+// Fields flagged as tags, and applying static "if missing"/"override"
+// tag lists. Keeping this in one place means the two encoders can't
+// drift out of sync with each other.
+package tagutil
+
+import (
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+)
+
+// Config controls how tags are extracted for a single Encode call. It
+// mirrors the relevant subset of the encoders' own config structs.
+type Config struct {
+	// String to demarcate embedded tag keys in the metric name
+	TagNamePrefix string
+	// String to demarcate embedded tag values in the metric name
+	TagValuePrefix string
+	// Add any Fields with TagNamePrefix as tags
+	FieldsToTags bool
+	// Static tags to add if not already present
+	MissingTags map[string]string
+	// Static tags to add/override unconditionally
+	OverrideTags map[string]string
+}
+
+// ParseStaticTags turns a "key=value" config list (as used by the
+// tags_if_missing/tags_override TOML options) into a lookup map.
+func ParseStaticTags(tags []string) map[string]string {
+	parsed := make(map[string]string)
+	for _, t := range tags {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+			parsed[kv[0]] = kv[1]
+		}
+	}
+	return parsed
+}
+
+// Extract splits the embedded tags out of metric, merges in any
+// matching message Fields and the configured static tags, and returns
+// the bare metric name plus the resulting tag set. tagKeys lists each
+// tag once, in the order it was first seen: embedded tags, then Field
+// tags, then static tags. Static tags are added in map iteration order,
+// so their order relative to each other can differ between calls.
+func Extract(pack *pipeline.PipelinePack, metric string, cfg Config) (
+	baseMetric string, tagKeys []string, tagMap map[string]interface{}) {
+
+	tagMap = make(map[string]interface{})
+
+	if cfg.TagNamePrefix != "" {
+		metricParts := strings.Split(metric, cfg.TagNamePrefix)
+		baseMetric = metricParts[0]
+		for _, tag := range metricParts[1:] {
+			kv := strings.SplitN(tag, cfg.TagValuePrefix, 2)
+			if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
+				tagMap[kv[0]] = kv[1]
+				tagKeys = append(tagKeys, kv[0])
+			}
+		}
+	} else {
+		baseMetric = metric
+	}
+
+	if cfg.FieldsToTags {
+		for _, field := range pack.Message.GetFields() {
+			k := field.GetName()
+			if strings.HasPrefix(k, cfg.TagNamePrefix) {
+				if k == "Metric" || k == "Value" {
+					continue
+				}
+				k = strings.TrimPrefix(k, cfg.TagNamePrefix)
+				if _, ok := tagMap[k]; !ok {
+					tagKeys = append(tagKeys, k)
+				}
+				tagMap[k] = field.GetValue()
+			}
+		}
+	}
+
+	for k, v := range cfg.MissingTags {
+		if _, ok := tagMap[k]; !ok {
+			tagKeys = append(tagKeys, k)
+			tagMap[k] = v
+		}
+	}
+
+	for k, v := range cfg.OverrideTags {
+		if _, ok := tagMap[k]; !ok {
+			tagKeys = append(tagKeys, k)
+		}
+		tagMap[k] = v
+	}
+
+	return
+}
@@ -0,0 +1,318 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// openTsdbPutResponse matches the JSON body OpenTSDB returns from
+// `/api/put?details`, which reports per-point failures alongside the
+// overall success/failed counts.
+type openTsdbPutResponse struct {
+	Failed  int                `json:"failed"`
+	Success int                `json:"success"`
+	Errors  []openTsdbPutError `json:"errors"`
+}
+
+type openTsdbPutError struct {
+	Datapoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+// OpenTsdbHttpOutput batches packs encoded (by an OpenTsdbJsonEncoder) into
+// the OpenTSDB HTTP JSON array format and POSTs them to one or more
+// /api/put endpoints, round-robining across URLs and retrying on 5xx.
+type OpenTsdbHttpOutput struct {
+	runner pipeline.OutputRunner
+	config *OpenTsdbHttpOutputConfig
+	client *http.Client
+
+	urlIdx uint64
+
+	mutex          sync.Mutex
+	queueDepth     int64
+	lastFlushNs    int64
+	httpErrorCount int64
+}
+
+type OpenTsdbHttpOutputConfig struct {
+	// One or more OpenTSDB /api/put base URLs, e.g. "http://tsdb:4242"
+	Urls []string `toml:"urls"`
+	// Maximum number of points to hold before flushing a batch. A partial
+	// batch is flushed on the standard `ticker_interval` instead.
+	BatchCount int `toml:"batch_count"`
+	// Maximum encoded size (bytes) to hold before flushing a batch
+	BatchBytes int `toml:"batch_bytes"`
+	// Gzip-compress the request body
+	UseGzip bool `toml:"use_gzip"`
+	// Number of retries on a 5xx response, with exponential backoff
+	MaxRetries int `toml:"max_retries"`
+	// HTTP client timeout in milliseconds
+	HttpTimeout uint32 `toml:"http_timeout"`
+}
+
+func (o *OpenTsdbHttpOutput) ConfigStruct() interface{} {
+	return &OpenTsdbHttpOutputConfig{
+		BatchCount:  300,
+		BatchBytes:  1 << 20,
+		MaxRetries:  3,
+		HttpTimeout: 5000,
+	}
+}
+
+func (o *OpenTsdbHttpOutput) Init(config interface{}) (err error) {
+	o.config = config.(*OpenTsdbHttpOutputConfig)
+	if len(o.config.Urls) == 0 {
+		return fmt.Errorf("OpenTsdbHttpOutput: at least one url is required")
+	}
+	o.client = &http.Client{
+		Timeout: time.Duration(o.config.HttpTimeout) * time.Millisecond,
+	}
+	return nil
+}
+
+func (o *OpenTsdbHttpOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	o.runner = or
+
+	inChan := or.InChan()
+	ticker := or.Ticker()
+
+	var batch [][]byte
+	var batchBytes int
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		o.send(batch)
+		batch = nil
+		batchBytes = 0
+		o.setQueueDepth(0)
+	}
+
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				flush()
+				return
+			}
+			outBytes, e := or.Encode(pack)
+			pack.Recycle(e)
+			if e != nil {
+				or.LogError(e)
+				continue
+			}
+			if outBytes == nil {
+				continue
+			}
+			batch = append(batch, outBytes)
+			batchBytes += len(outBytes)
+			o.setQueueDepth(int64(len(batch)))
+			if len(batch) >= o.config.BatchCount || batchBytes >= o.config.BatchBytes {
+				flush()
+			}
+		case <-ticker:
+			flush()
+		}
+	}
+}
+
+// buildBatchBody wraps a batch of per-point JSON objects (as produced by
+// OpenTsdbJsonEncoder) into a single OpenTSDB HTTP JSON array body.
+func buildBatchBody(batch [][]byte) []byte {
+	body := new(bytes.Buffer)
+	body.WriteByte('[')
+	for i, point := range batch {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(point)
+	}
+	body.WriteByte(']')
+	return body.Bytes()
+}
+
+// maybeGzip gzip-compresses payload when enabled, falling back to the
+// uncompressed payload if compression fails.
+func maybeGzip(payload []byte, enabled bool) (out []byte, gzipped bool) {
+	if !enabled {
+		return payload, false
+	}
+	gzBuf := new(bytes.Buffer)
+	gz := gzip.NewWriter(gzBuf)
+	if _, err := gz.Write(payload); err != nil || gz.Close() != nil {
+		return payload, false
+	}
+	return gzBuf.Bytes(), true
+}
+
+// send wraps the batch in the OpenTSDB HTTP JSON array format, optionally
+// gzips it, and POSTs it to the next URL in the round-robin, retrying
+// with exponential backoff on a 5xx response.
+func (o *OpenTsdbHttpOutput) send(batch [][]byte) {
+	start := time.Now()
+
+	payload, gzipped := maybeGzip(buildBatchBody(batch), o.config.UseGzip)
+
+	url := o.nextUrl() + "/api/put?details"
+
+	retryHelper, err := pipeline.NewRetryHelper(pipeline.RetryOptions{
+		MaxDelay:   "30s",
+		Delay:      "500ms",
+		MaxRetries: o.config.MaxRetries,
+	})
+	if err != nil {
+		o.runner.LogError(err)
+		return
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= o.config.MaxRetries; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+		if err != nil {
+			o.runner.LogError(err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		resp, err := o.client.Do(req)
+		if err != nil {
+			lastErr = err
+			retryHelper.Wait()
+			continue
+		}
+
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("OpenTsdbHttpOutput: %s returned %d: %s", url, resp.StatusCode, respBody)
+			retryHelper.Wait()
+			continue
+		}
+
+		if resp.StatusCode >= 400 {
+			o.incErrorCount()
+			o.logPutErrors(url, respBody)
+		}
+
+		o.setLastFlush(time.Since(start))
+		return
+	}
+
+	o.incErrorCount()
+	o.setLastFlush(time.Since(start))
+	o.runner.LogError(fmt.Errorf("OpenTsdbHttpOutput: giving up after %d retries: %s",
+		o.config.MaxRetries, lastErr))
+}
+
+// putErrorMessages unmarshals the `/api/put?details` response body into
+// one message per per-point failure TSDB reported, led by a summary line.
+// If the body doesn't parse as the expected shape, it falls back to a
+// single message wrapping the raw body so nothing is silently swallowed.
+func putErrorMessages(url string, respBody []byte) []string {
+	var parsed openTsdbPutResponse
+	if err := json.Unmarshal(respBody, &parsed); err != nil || len(parsed.Errors) == 0 {
+		return []string{fmt.Sprintf("OpenTsdbHttpOutput: %s rejected points: %s", url, respBody)}
+	}
+
+	messages := make([]string, 0, len(parsed.Errors)+1)
+	messages = append(messages, fmt.Sprintf("OpenTsdbHttpOutput: %s rejected %d of %d points",
+		url, parsed.Failed, parsed.Failed+parsed.Success))
+	for _, e := range parsed.Errors {
+		messages = append(messages, fmt.Sprintf("OpenTsdbHttpOutput: point rejected: %s (%s)", e.Error, e.Datapoint))
+	}
+	return messages
+}
+
+// logPutErrors logs every message putErrorMessages extracts from a
+// rejected `/api/put?details` response.
+func (o *OpenTsdbHttpOutput) logPutErrors(url string, respBody []byte) {
+	for _, msg := range putErrorMessages(url, respBody) {
+		o.runner.LogError(fmt.Errorf("%s", msg))
+	}
+}
+
+func (o *OpenTsdbHttpOutput) nextUrl() string {
+	idx := atomic.AddUint64(&o.urlIdx, 1)
+	return o.config.Urls[int(idx-1)%len(o.config.Urls)]
+}
+
+func (o *OpenTsdbHttpOutput) setQueueDepth(n int64) {
+	o.mutex.Lock()
+	o.queueDepth = n
+	o.mutex.Unlock()
+}
+
+func (o *OpenTsdbHttpOutput) setLastFlush(d time.Duration) {
+	o.mutex.Lock()
+	o.lastFlushNs = d.Nanoseconds()
+	o.mutex.Unlock()
+}
+
+func (o *OpenTsdbHttpOutput) incErrorCount() {
+	o.mutex.Lock()
+	o.httpErrorCount++
+	o.mutex.Unlock()
+}
+
+// ReportMsg implements the Heka reports interface, surfacing queue depth,
+// last flush latency and HTTP error counts via the dashboard.
+func (o *OpenTsdbHttpOutput) ReportMsg(msg *message.Message) error {
+	o.mutex.Lock()
+	depth, lastFlushNs, errCount := o.queueDepth, o.lastFlushNs, o.httpErrorCount
+	o.mutex.Unlock()
+
+	if err := addReportField(msg, "QueueDepth", depth); err != nil {
+		return err
+	}
+	if err := addReportField(msg, "LastFlushMicroseconds", lastFlushNs/1e3); err != nil {
+		return err
+	}
+	if err := addReportField(msg, "HttpErrorCount", errCount); err != nil {
+		return err
+	}
+	return nil
+}
+
+func addReportField(msg *message.Message, name string, value int64) error {
+	field, err := message.NewField(name, value, "count")
+	if err != nil {
+		return fmt.Errorf("error adding field '%s': %s", name, err)
+	}
+	msg.AddField(field)
+	return nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("OpenTsdbHttpOutput", func() interface{} {
+		return new(OpenTsdbHttpOutput)
+	})
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBuildBatchBodyWrapsPointsInJsonArray(t *testing.T) {
+	batch := [][]byte{[]byte(`{"metric":"a"}`), []byte(`{"metric":"b"}`)}
+	got := string(buildBatchBody(batch))
+	want := `[{"metric":"a"},{"metric":"b"}]`
+	if got != want {
+		t.Errorf("buildBatchBody() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildBatchBodyEmptyBatch(t *testing.T) {
+	if got := string(buildBatchBody(nil)); got != "[]" {
+		t.Errorf("buildBatchBody(nil) = %q, want %q", got, "[]")
+	}
+}
+
+func TestMaybeGzipDisabledReturnsPayloadUnchanged(t *testing.T) {
+	payload := []byte(`{"metric":"a"}`)
+	out, gzipped := maybeGzip(payload, false)
+	if gzipped {
+		t.Errorf("expected gzipped=false when disabled")
+	}
+	if string(out) != string(payload) {
+		t.Errorf("expected payload unchanged when gzip disabled")
+	}
+}
+
+func TestMaybeGzipEnabledProducesValidGzip(t *testing.T) {
+	payload := []byte(`{"metric":"a","value":1}`)
+	out, gzipped := maybeGzip(payload, true)
+	if !gzipped {
+		t.Fatalf("expected gzipped=true when enabled")
+	}
+
+	r, err := gzip.NewReader(strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatalf("output is not valid gzip: %s", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	if string(decompressed) != string(payload) {
+		t.Errorf("decompressed payload = %q, want %q", decompressed, payload)
+	}
+}
+
+func TestNextUrlRoundRobins(t *testing.T) {
+	o := &OpenTsdbHttpOutput{config: &OpenTsdbHttpOutputConfig{
+		Urls: []string{"http://a", "http://b", "http://c"},
+	}}
+
+	got := []string{o.nextUrl(), o.nextUrl(), o.nextUrl(), o.nextUrl()}
+	want := []string{"http://a", "http://b", "http://c", "http://a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("nextUrl() call %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPutErrorMessagesParsesDetailsResponse(t *testing.T) {
+	body := []byte(`{"failed":1,"success":2,"errors":[{"datapoint":{"metric":"foo"},"error":"invalid tag"}]}`)
+	messages := putErrorMessages("http://tsdb", body)
+
+	if len(messages) != 2 {
+		t.Fatalf("expected a summary line plus one per-point error, got %d: %v", len(messages), messages)
+	}
+	if !strings.Contains(messages[0], "rejected 1 of 3") {
+		t.Errorf("summary message = %q, want it to mention '1 of 3'", messages[0])
+	}
+	if !strings.Contains(messages[1], "invalid tag") {
+		t.Errorf("per-point message = %q, want it to mention the TSDB error", messages[1])
+	}
+}
+
+func TestPutErrorMessagesFallsBackOnUnparseableBody(t *testing.T) {
+	body := []byte("not json")
+	messages := putErrorMessages("http://tsdb", body)
+
+	if len(messages) != 1 {
+		t.Fatalf("expected a single fallback message, got %d: %v", len(messages), messages)
+	}
+	if !strings.Contains(messages[0], "not json") {
+		t.Errorf("fallback message = %q, want it to include the raw body", messages[0])
+	}
+}
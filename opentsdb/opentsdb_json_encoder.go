@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2016
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hynd/heka-tsutils-plugins/internal/tagutil"
+	"github.com/mozilla-services/heka/pipeline"
+	"time"
+)
+
+// OpenTsdbJsonEncoder emits a single JSON object per pack in the shape
+// OpenTSDB's HTTP /api/put endpoint expects. OpenTsdbHttpOutput wraps one
+// or more of these in a JSON array to submit a batch.
+type OpenTsdbJsonEncoder struct {
+	config       *OpenTsdbJsonEncoderConfig
+	missingTags  map[string]string
+	overrideTags map[string]string
+}
+
+type OpenTsdbJsonEncoderConfig struct {
+	// String to demarcate embedded tag keys in the metric name
+	TagNamePrefix string `toml:"tagname_prefix"`
+	// String to demarcate embedded tag values in the metric name, defaults to '.'
+	TagValuePrefix string `toml:"tagvalue_prefix"`
+	// Base metric timestamp on either message Timestamp or "now"
+	TsFromMessage bool `toml:"ts_from_message"`
+	// Add any Fields with TagNamePrefix as tags
+	FieldsToTags bool `toml:"fields_to_tags"`
+	// Array of static tags to add if missing
+	AddTagsIfMissing []string `toml:"tags_if_missing"`
+	// Array of static tags to override unconditionally
+	AddTagsOverride []string `toml:"tags_override"`
+}
+
+type openTsdbJsonPoint struct {
+	Metric    string                 `json:"metric"`
+	Timestamp int64                  `json:"timestamp"`
+	Value     interface{}            `json:"value"`
+	Tags      map[string]interface{} `json:"tags"`
+}
+
+func (je *OpenTsdbJsonEncoder) ConfigStruct() interface{} {
+	return &OpenTsdbJsonEncoderConfig{
+		TsFromMessage: true,
+		FieldsToTags:  true,
+	}
+}
+
+func (je *OpenTsdbJsonEncoder) Init(config interface{}) (err error) {
+	je.config = config.(*OpenTsdbJsonEncoderConfig)
+	if je.config.TagNamePrefix != "" && je.config.TagValuePrefix == "" {
+		je.config.TagValuePrefix = "."
+	}
+
+	je.missingTags = tagutil.ParseStaticTags(je.config.AddTagsIfMissing)
+	je.overrideTags = tagutil.ParseStaticTags(je.config.AddTagsOverride)
+
+	return
+}
+
+func (je *OpenTsdbJsonEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+
+	metric, ok := pack.Message.GetFieldValue("Metric")
+	if !ok {
+		return nil, fmt.Errorf("Unable to find Field[Metric] in message")
+	}
+	value, ok := pack.Message.GetFieldValue("Value")
+	if !ok {
+		return nil, fmt.Errorf("Unable to find Field[Value] field in message")
+	}
+
+	baseMetric, tagKeys, tagMap := tagutil.Extract(pack, metric.(string), tagutil.Config{
+		TagNamePrefix:  je.config.TagNamePrefix,
+		TagValuePrefix: je.config.TagValuePrefix,
+		FieldsToTags:   je.config.FieldsToTags,
+		MissingTags:    je.missingTags,
+		OverrideTags:   je.overrideTags,
+	})
+
+	tags := make(map[string]interface{}, len(tagKeys))
+	for _, k := range tagKeys {
+		tags[k] = tagMap[k]
+	}
+
+	var timestamp time.Time
+	if je.config.TsFromMessage {
+		timestamp = time.Unix(0, pack.Message.GetTimestamp()).UTC()
+	} else {
+		timestamp = time.Now().UTC()
+	}
+
+	point := openTsdbJsonPoint{
+		Metric:    baseMetric,
+		Timestamp: timestamp.Unix(),
+		Value:     value,
+		Tags:      tags,
+	}
+
+	return json.Marshal(point)
+}
+
+func init() {
+	pipeline.RegisterPlugin("OpenTsdbJsonEncoder", func() interface{} {
+		return new(OpenTsdbJsonEncoder)
+	})
+}
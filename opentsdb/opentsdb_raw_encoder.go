@@ -16,13 +16,21 @@ package opentsdb
 
 import (
 	"bytes"
+	"container/list"
 	"fmt"
+	"github.com/hynd/heka-tsutils-plugins/internal/tagutil"
 	"github.com/mozilla-services/heka/pipeline"
-	"strings"
+	"log"
+	"sync"
 	"time"
 )
 
-type dedupe struct {
+// dedupeEntry is the LRU payload: the last line emitted for a given
+// metric+tagset, whether it was last suppressed as a duplicate, and the
+// timestamp of the last point emitted for it (suppressed duplicates leave
+// it unchanged).
+type dedupeEntry struct {
+	key     string
 	data    []byte
 	skipped bool
 	ts      int64
@@ -33,9 +41,16 @@ type dedupe struct {
 // suitable for ingest into OpenTSDB over TCP.
 type OpenTsdbRawEncoder struct {
 	config       *OpenTsdbRawEncoderConfig
-	dedupeBuffer map[string]dedupe
 	missingTags  map[string]string
 	overrideTags map[string]string
+
+	mutex         sync.Mutex
+	dedupeBuffer  map[string]*list.Element
+	dedupeLru     *list.List
+	evictionCount int64
+	pending       []byte
+
+	stopChan chan struct{}
 }
 
 type OpenTsdbRawEncoderConfig struct {
@@ -47,8 +62,12 @@ type OpenTsdbRawEncoderConfig struct {
 	TsFromMessage bool `toml:"ts_from_message"`
 	// Add any Fields with TagNamePrefix as tags
 	FieldsToTags bool `toml:"fields_to_tags"`
-	// Maximum window size (seconds) for dedupe
+	// Maximum window size (seconds) for dedupe, and the interval at which
+	// the heartbeat goroutine re-emits still-skipped points
 	DedupeFlush int64 `toml:"dedupe_window"`
+	// Maximum number of distinct metric+tagset series to track for dedupe;
+	// the oldest series is evicted once this is exceeded
+	DedupeMaxSeries int `toml:"dedupe_max_series"`
 	// Array of static tags to add if missing
 	AddTagsIfMissing []string `toml:"tags_if_missing"`
 	// Array of static tags to override unconditionally
@@ -57,39 +76,96 @@ type OpenTsdbRawEncoderConfig struct {
 
 func (oe *OpenTsdbRawEncoder) ConfigStruct() interface{} {
 	return &OpenTsdbRawEncoderConfig{
-		TsFromMessage: true,
-		FieldsToTags:  true,
+		TsFromMessage:   true,
+		FieldsToTags:    true,
+		DedupeMaxSeries: 100000,
 	}
 }
 
 func (oe *OpenTsdbRawEncoder) Init(config interface{}) (err error) {
 	oe.config = config.(*OpenTsdbRawEncoderConfig)
-	oe.dedupeBuffer = make(map[string]dedupe)
-	oe.missingTags = make(map[string]string)
-	oe.overrideTags = make(map[string]string)
+	oe.dedupeBuffer = make(map[string]*list.Element)
+	oe.dedupeLru = list.New()
 	// We need to split a value from the key somehow, default to '.'
 	if oe.config.TagNamePrefix != "" && oe.config.TagValuePrefix == "" {
 		oe.config.TagValuePrefix = "."
 	}
 
-	if len(oe.config.AddTagsIfMissing) > 0 {
-		for _, t := range oe.config.AddTagsIfMissing {
-			kv := strings.SplitN(t, "=", 2)
-			if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
-				oe.missingTags[kv[0]] = kv[1]
-			}
+	oe.missingTags = tagutil.ParseStaticTags(oe.config.AddTagsIfMissing)
+	oe.overrideTags = tagutil.ParseStaticTags(oe.config.AddTagsOverride)
+
+	if oe.config.DedupeFlush > 0 {
+		oe.stopChan = make(chan struct{})
+		go oe.heartbeatLoop()
+	}
+
+	return
+}
+
+// Stop implements `NeedsStopping`, so the heartbeat goroutine is stopped
+// when the encoder is torn down rather than leaking.
+func (oe *OpenTsdbRawEncoder) Stop() {
+	if oe.stopChan != nil {
+		close(oe.stopChan)
+	}
+}
+
+// heartbeatLoop wakes up every DedupeFlush seconds and queues a "still
+// alive" copy of any series that's currently being skipped as a
+// duplicate, so flat-lined series don't drop out of OpenTSDB once its
+// retention interval passes. The queued bytes ride out on the next call
+// to Encode, since the encoder has no pipeline access of its own.
+func (oe *OpenTsdbRawEncoder) heartbeatLoop() {
+	ticker := time.NewTicker(time.Duration(oe.config.DedupeFlush) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			oe.emitHeartbeats()
+		case <-oe.stopChan:
+			return
 		}
 	}
-	if len(oe.config.AddTagsOverride) > 0 {
-		for _, t := range oe.config.AddTagsOverride {
-			kv := strings.SplitN(t, "=", 2)
-			if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
-				oe.overrideTags[kv[0]] = kv[1]
-			}
+}
+
+func (oe *OpenTsdbRawEncoder) emitHeartbeats() {
+	now := time.Now().UnixNano()
+	window := oe.config.DedupeFlush * 1e9
+
+	oe.mutex.Lock()
+	defer oe.mutex.Unlock()
+	for e := oe.dedupeLru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*dedupeEntry)
+		if entry.skipped && now-entry.ts >= window {
+			oe.pending = append(oe.pending, entry.data...)
+			entry.ts = now
 		}
 	}
+}
 
-	return
+// touch records the latest line seen for bufkey, moving it to the front
+// of the LRU and evicting the oldest series if DedupeMaxSeries is
+// exceeded. Must be called with oe.mutex held.
+func (oe *OpenTsdbRawEncoder) touch(bufkey string, data []byte, skipped bool, ts int64, val interface{}) {
+	if e, ok := oe.dedupeBuffer[bufkey]; ok {
+		entry := e.Value.(*dedupeEntry)
+		entry.data, entry.skipped, entry.ts, entry.val = data, skipped, ts, val
+		oe.dedupeLru.MoveToFront(e)
+		return
+	}
+
+	e := oe.dedupeLru.PushFront(&dedupeEntry{key: bufkey, data: data, skipped: skipped, ts: ts, val: val})
+	oe.dedupeBuffer[bufkey] = e
+
+	if oe.config.DedupeMaxSeries > 0 && oe.dedupeLru.Len() > oe.config.DedupeMaxSeries {
+		oldest := oe.dedupeLru.Back()
+		oe.dedupeLru.Remove(oldest)
+		delete(oe.dedupeBuffer, oldest.Value.(*dedupeEntry).key)
+		oe.evictionCount++
+		log.Printf("opentsdb: evicted oldest series from dedupe cache (DedupeMaxSeries=%d, total evictions=%d)",
+			oe.config.DedupeMaxSeries, oe.evictionCount)
+	}
 }
 
 func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
@@ -102,20 +178,16 @@ func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte
 		return nil, err
 	}
 
-	buf.WriteString("put ")
+	baseMetric, tagKeys, tagMap := tagutil.Extract(pack, metric.(string), tagutil.Config{
+		TagNamePrefix:  oe.config.TagNamePrefix,
+		TagValuePrefix: oe.config.TagValuePrefix,
+		FieldsToTags:   oe.config.FieldsToTags,
+		MissingTags:    oe.missingTags,
+		OverrideTags:   oe.overrideTags,
+	})
 
-	var tags []string
-	// if we're looking for dynamic field data embedded in the metric name...
-	if oe.config.TagNamePrefix != "" {
-		metric_parts := strings.Split(metric.(string), oe.config.TagNamePrefix)
-		// write the metric name stripped of embedded tags
-		buf.WriteString(metric_parts[0])
-		// everything else will be embedded tag data
-		tags = metric_parts[1:]
-	} else {
-		// just use the whole metric name
-		buf.WriteString(fmt.Sprint(metric))
-	}
+	buf.WriteString("put ")
+	buf.WriteString(baseMetric)
 	buf.WriteString(" ")
 
 	// timestamp
@@ -136,50 +208,6 @@ func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte
 	}
 	buf.WriteString(fmt.Sprint(value))
 
-	// tags
-	tagMap := make(map[string]interface{})
-	var tagKeys []string
-	// start with any tags that were embedded in the metric name
-	for _, tag := range tags {
-		kv := strings.SplitN(tag, oe.config.TagValuePrefix, 2)
-		if len(kv) == 2 && kv[0] != "" && kv[1] != "" {
-			tagMap[kv[0]] = kv[1]
-			tagKeys = append(tagKeys, kv[0])
-		}
-	}
-
-	// add any tags from dynamic Message fields that have the TagNamePrefix
-	if oe.config.FieldsToTags {
-		fields := pack.Message.GetFields()
-		for _, field := range fields {
-			k := field.GetName()
-			if strings.HasPrefix(k, oe.config.TagNamePrefix) {
-				if k == "Metric" || k == "Value" {
-					continue
-				}
-				k = strings.TrimLeft(k, oe.config.TagNamePrefix)
-				tagMap[k] = field.GetValue()
-				tagKeys = append(tagKeys, k)
-			}
-		}
-	}
-
-	// add any tags if they're missing
-	for k, v := range oe.missingTags {
-		if _, ok := tagMap[k]; !ok {
-			tagKeys = append(tagKeys, k)
-			tagMap[k] = v
-		}
-	}
-
-	// override any tags unconditionally
-	for k, v := range oe.overrideTags {
-		if _, ok := tagMap[k]; !ok {
-			tagKeys = append(tagKeys, k)
-		}
-		tagMap[k] = v
-	}
-
 	// build the final tag string
 	tagString := new(bytes.Buffer)
 	for _, k := range tagKeys {
@@ -189,33 +217,37 @@ func (oe *OpenTsdbRawEncoder) Encode(pack *pipeline.PipelinePack) (output []byte
 	buf.Write(tagString.Bytes())
 	buf.WriteString("\n")
 
-	// dedupe
-	var previous []byte
+	// any heartbeats queued up by the background goroutine ride out
+	// ahead of whatever this call returns
+	oe.mutex.Lock()
+	previous := oe.pending
+	oe.pending = nil
+
 	if oe.config.DedupeFlush > 0 {
 		bufkey := fmt.Sprintf("%s:%s", metric, tagString)
 
-		if _, ok := oe.dedupeBuffer[bufkey]; ok {
+		if e, ok := oe.dedupeBuffer[bufkey]; ok {
+			entry := e.Value.(*dedupeEntry)
 
-			// if we've already seen the value, add it to the buffer
-			if oe.dedupeBuffer[bufkey].val == value &&
-				(timestamp.UnixNano()-oe.dedupeBuffer[bufkey].ts < oe.config.DedupeFlush*1e9) {
-
-				oe.dedupeBuffer[bufkey] = dedupe{data: buf.Bytes(), skipped: true, val: value, ts: oe.dedupeBuffer[bufkey].ts}
-				return nil, nil
+			// if we've already seen the value, suppress it
+			if entry.val == value && timestamp.UnixNano()-entry.ts < oe.config.DedupeFlush*1e9 {
+				oe.touch(bufkey, buf.Bytes(), true, entry.ts, value)
+				oe.mutex.Unlock()
+				return previous, nil
 			}
 
-			// if the value's changed, and we've skipped it before (or it's been > the flush interval)
-			// return the stored data point, and the current one
-			if (oe.dedupeBuffer[bufkey].skipped ||
-				(oe.dedupeBuffer[bufkey].skipped && timestamp.UnixNano()-oe.dedupeBuffer[bufkey].ts >= oe.config.DedupeFlush*1e9)) &&
-				oe.dedupeBuffer[bufkey].val != value {
-
-				previous = oe.dedupeBuffer[bufkey].data
+			// the value's changed: if we'd been skipping duplicates, or
+			// it's been longer than the flush window since we last sent
+			// anything for this series, emit the last stored point too
+			if (entry.skipped || timestamp.UnixNano()-entry.ts >= oe.config.DedupeFlush*1e9) &&
+				entry.val != value {
+				previous = append(previous, entry.data...)
 			}
 		}
 		// track the last data point
-		oe.dedupeBuffer[bufkey] = dedupe{data: buf.Bytes(), val: value, ts: timestamp.UnixNano()}
+		oe.touch(bufkey, buf.Bytes(), false, timestamp.UnixNano(), value)
 	}
+	oe.mutex.Unlock()
 
 	return append(previous, buf.Bytes()...), nil
 }
@@ -0,0 +1,175 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd (kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package opentsdb
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"testing"
+	"time"
+)
+
+func newTestEncoder(maxSeries int, dedupeFlush int64) *OpenTsdbRawEncoder {
+	return &OpenTsdbRawEncoder{
+		config: &OpenTsdbRawEncoderConfig{
+			DedupeMaxSeries: maxSeries,
+			DedupeFlush:     dedupeFlush,
+			TsFromMessage:   true,
+		},
+		dedupeBuffer: make(map[string]*list.Element),
+		dedupeLru:    list.New(),
+	}
+}
+
+func newRawTestPack(metric string, value float64, ts int64) *pipeline.PipelinePack {
+	pack := &pipeline.PipelinePack{Message: new(message.Message)}
+
+	addField := func(name string, value interface{}) {
+		field, err := message.NewField(name, value, "")
+		if err != nil {
+			panic(err)
+		}
+		pack.Message.AddField(field)
+	}
+
+	addField("Metric", metric)
+	addField("Value", value)
+	pack.Message.SetTimestamp(ts)
+
+	return pack
+}
+
+func TestTouchEvictsOldestWhenOverMaxSeries(t *testing.T) {
+	oe := newTestEncoder(2, 60)
+
+	oe.touch("a", []byte("a"), false, 1, 1.0)
+	oe.touch("b", []byte("b"), false, 2, 1.0)
+	oe.touch("c", []byte("c"), false, 3, 1.0)
+
+	if oe.dedupeLru.Len() != 2 {
+		t.Fatalf("expected LRU to be capped at 2 entries, got %d", oe.dedupeLru.Len())
+	}
+	if _, ok := oe.dedupeBuffer["a"]; ok {
+		t.Errorf("expected oldest key 'a' to be evicted")
+	}
+	if _, ok := oe.dedupeBuffer["b"]; !ok {
+		t.Errorf("expected key 'b' to survive eviction")
+	}
+	if _, ok := oe.dedupeBuffer["c"]; !ok {
+		t.Errorf("expected key 'c' to survive eviction")
+	}
+	if oe.evictionCount != 1 {
+		t.Errorf("expected evictionCount 1, got %d", oe.evictionCount)
+	}
+}
+
+func TestTouchOnExistingKeyMovesToFrontWithoutEvicting(t *testing.T) {
+	oe := newTestEncoder(2, 60)
+
+	oe.touch("a", []byte("a"), false, 1, 1.0)
+	oe.touch("b", []byte("b"), false, 2, 1.0)
+	// re-touching "a" should bump it to the front, so adding "c" now
+	// evicts "b" instead of "a"
+	oe.touch("a", []byte("a2"), false, 3, 2.0)
+	oe.touch("c", []byte("c"), false, 4, 1.0)
+
+	if _, ok := oe.dedupeBuffer["a"]; !ok {
+		t.Errorf("expected recently-touched key 'a' to survive eviction")
+	}
+	if _, ok := oe.dedupeBuffer["b"]; ok {
+		t.Errorf("expected least-recently-used key 'b' to be evicted")
+	}
+}
+
+func TestEmitHeartbeatsOnlySkippedEntriesPastWindow(t *testing.T) {
+	oe := newTestEncoder(100, 10) // 10 second flush window
+
+	now := time.Now().UnixNano()
+	stale := now - int64(20*time.Second)
+	fresh := now - int64(1*time.Second)
+
+	oe.touch("stale-skipped", []byte("stale-skipped-data"), true, stale, 1.0)
+	oe.touch("fresh-skipped", []byte("fresh-skipped-data"), true, fresh, 1.0)
+	oe.touch("stale-not-skipped", []byte("stale-not-skipped-data"), false, stale, 1.0)
+
+	oe.emitHeartbeats()
+
+	if !bytes.Contains(oe.pending, []byte("stale-skipped-data")) {
+		t.Errorf("expected heartbeat for stale, skipped series; pending=%q", oe.pending)
+	}
+	if bytes.Contains(oe.pending, []byte("fresh-skipped-data")) {
+		t.Errorf("did not expect heartbeat for series still within the flush window; pending=%q", oe.pending)
+	}
+	if bytes.Contains(oe.pending, []byte("stale-not-skipped-data")) {
+		t.Errorf("did not expect heartbeat for a series that wasn't being skipped; pending=%q", oe.pending)
+	}
+
+	entry := oe.dedupeBuffer["stale-skipped"].Value.(*dedupeEntry)
+	if entry.ts < now {
+		t.Errorf("expected heartbeat to refresh the entry's timestamp so it isn't re-emitted every tick")
+	}
+}
+
+func TestEncodeEmitsFirstPointForNewSeries(t *testing.T) {
+	oe := newTestEncoder(100, 60)
+
+	out, err := oe.Encode(newRawTestPack("foo", 1.0, 1*int64(time.Second)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Contains(out, []byte("put foo 1 1")) {
+		t.Errorf("expected a 'put foo 1 1' line, got %q", out)
+	}
+}
+
+func TestEncodeSuppressesRepeatedValueWithinWindow(t *testing.T) {
+	oe := newTestEncoder(100, 60)
+
+	if _, err := oe.Encode(newRawTestPack("foo", 1.0, 1*int64(time.Second))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := oe.Encode(newRawTestPack("foo", 1.0, 2*int64(time.Second)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out) != 0 {
+		t.Errorf("expected a repeated value within the dedupe window to be suppressed, got %q", out)
+	}
+}
+
+func TestEncodeEmitsLastSuppressedPointWhenValueChanges(t *testing.T) {
+	oe := newTestEncoder(100, 60)
+
+	if _, err := oe.Encode(newRawTestPack("foo", 1.0, 1*int64(time.Second))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := oe.Encode(newRawTestPack("foo", 1.0, 2*int64(time.Second))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := oe.Encode(newRawTestPack("foo", 2.0, 3*int64(time.Second)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Contains(out, []byte("put foo 2 1")) {
+		t.Errorf("expected the last suppressed duplicate to ride out alongside the new value, got %q", out)
+	}
+	if !bytes.Contains(out, []byte("put foo 3 2")) {
+		t.Errorf("expected the new changed value to be emitted, got %q", out)
+	}
+}
@@ -0,0 +1,346 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"fmt"
+	"github.com/beorn7/perks/quantile"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StatsdAggregator buckets the Fields produced by StatsdDecoder by Metric
+// plus tag set over a configurable flush interval, and injects aggregated
+// packs back into the pipeline carrying the decoder's Metric, Value and
+// tag Fields, so OpenTsdbRawEncoder needs no changes. Injected packs have
+// no Modifier or Sampling Field.
+type StatsdAggregator struct {
+	runner FilterRunner
+	helper PluginHelper
+	config *StatsdAggregatorConfig
+
+	counters map[string]*counterAgg
+	gauges   map[string]*gaugeAgg
+	sets     map[string]*setAgg
+	timers   map[string]*timerAgg
+}
+
+type StatsdAggregatorConfig struct {
+	// Prefix identifying which Fields on an incoming pack are tags
+	TagNamePrefix string `toml:"tagname_prefix"`
+	// Quantiles to compute for ms/h/d metrics, emitted as "<metric>.pNN"
+	// (0.5 is emitted as "<metric>.median")
+	Percentiles []float64 `toml:"percentiles"`
+	// Targeted error for the streaming quantile estimator
+	QuantileEpsilon float64 `toml:"quantile_epsilon"`
+}
+
+type counterAgg struct {
+	metric string
+	tags   map[string]interface{}
+	sum    float64
+}
+
+type gaugeAgg struct {
+	metric string
+	tags   map[string]interface{}
+	value  float64
+}
+
+type setAgg struct {
+	metric string
+	tags   map[string]interface{}
+	values map[interface{}]bool
+}
+
+type timerAgg struct {
+	metric string
+	tags   map[string]interface{}
+	stream *quantile.Stream
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func (a *StatsdAggregator) ConfigStruct() interface{} {
+	return &StatsdAggregatorConfig{
+		Percentiles:     []float64{0.5, 0.9, 0.95, 0.99},
+		QuantileEpsilon: 0.01,
+	}
+}
+
+func (a *StatsdAggregator) Init(config interface{}) error {
+	a.config = config.(*StatsdAggregatorConfig)
+	a.counters = make(map[string]*counterAgg)
+	a.gauges = make(map[string]*gaugeAgg)
+	a.sets = make(map[string]*setAgg)
+	a.timers = make(map[string]*timerAgg)
+	return nil
+}
+
+func (a *StatsdAggregator) Run(fr FilterRunner, h PluginHelper) (err error) {
+	a.runner = fr
+	a.helper = h
+
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+
+	for {
+		select {
+		case pack, ok := <-inChan:
+			if !ok {
+				return
+			}
+			a.accumulate(pack)
+			pack.Recycle(nil)
+		case <-ticker:
+			a.flush(fr)
+		}
+	}
+}
+
+// key builds a stable "metric\x00tag=val,tag=val" grouping key so the same
+// (metric, tagset) pair always lands in the same bucket regardless of the
+// order tags arrived in on the pack.
+func (a *StatsdAggregator) key(metric string, tags map[string]interface{}) string {
+	if len(tags) == 0 {
+		return metric
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, tags[k]))
+	}
+	return metric + "\x00" + strings.Join(parts, ",")
+}
+
+func (a *StatsdAggregator) tagsFor(pack *PipelinePack) map[string]interface{} {
+	tags := make(map[string]interface{})
+	if a.config.TagNamePrefix == "" {
+		return tags
+	}
+	for _, field := range pack.Message.GetFields() {
+		k := field.GetName()
+		if strings.HasPrefix(k, a.config.TagNamePrefix) {
+			tags[strings.TrimPrefix(k, a.config.TagNamePrefix)] = field.GetValue()
+		}
+	}
+	return tags
+}
+
+func (a *StatsdAggregator) accumulate(pack *PipelinePack) {
+	metric, ok := pack.Message.GetFieldValue("Metric")
+	if !ok {
+		return
+	}
+	value, ok := pack.Message.GetFieldValue("Value")
+	if !ok {
+		return
+	}
+	modifier, ok := pack.Message.GetFieldValue("Modifier")
+	if !ok {
+		return
+	}
+	val, ok := value.(float64)
+	if !ok {
+		return
+	}
+	rate := 1.0
+	if sampling, ok := pack.Message.GetFieldValue("Sampling"); ok {
+		if r, ok := sampling.(float64); ok && r > 0 {
+			rate = r
+		}
+	}
+
+	tags := a.tagsFor(pack)
+	k := a.key(metric.(string), tags)
+
+	switch modifier.(string) {
+	case "c":
+		ctr, ok := a.counters[k]
+		if !ok {
+			ctr = &counterAgg{metric: metric.(string), tags: tags}
+			a.counters[k] = ctr
+		}
+		ctr.sum += val / rate
+	case "g":
+		a.gauges[k] = &gaugeAgg{metric: metric.(string), tags: tags, value: val}
+	case "s":
+		set, ok := a.sets[k]
+		if !ok {
+			set = &setAgg{metric: metric.(string), tags: tags, values: make(map[interface{}]bool)}
+			a.sets[k] = set
+		}
+		set.values[val] = true
+	case "ms", "h", "d":
+		t, ok := a.timers[k]
+		if !ok {
+			t = &timerAgg{
+				metric: metric.(string),
+				tags:   tags,
+				stream: quantile.NewTargeted(a.percentileMap()),
+				min:    val,
+				max:    val,
+			}
+			a.timers[k] = t
+		}
+		t.stream.Insert(val)
+		t.count++
+		t.sum += val
+		if val < t.min {
+			t.min = val
+		}
+		if val > t.max {
+			t.max = val
+		}
+	}
+}
+
+func (a *StatsdAggregator) percentileMap() map[float64]float64 {
+	objectives := make(map[float64]float64, len(a.config.Percentiles))
+	for _, p := range a.config.Percentiles {
+		objectives[p] = a.config.QuantileEpsilon
+	}
+	return objectives
+}
+
+// percentileSuffix renders a percentile like 0.95 as ".p95" and 0.999 as
+// ".p999", rounding to the nearest tenth of a percent so percentiles of
+// 0.1 and above that round differently (e.g. 0.99 and 0.999) never
+// collide on the same suffix.
+func percentileSuffix(p float64) string {
+	scaled := int(math.Round(p * 1000))
+	if scaled%10 == 0 {
+		return fmt.Sprintf(".p%d", scaled/10)
+	}
+	return fmt.Sprintf(".p%d", scaled)
+}
+
+// flushRow is one (metric, value, tagset) triple ready to be injected as a
+// pack; pulled out of flush so the aggregation math can be tested without a
+// FilterRunner/PluginHelper in the loop.
+type flushRow struct {
+	metric string
+	value  float64
+	tags   map[string]interface{}
+}
+
+// flushRows drains the current aggregation windows into flushRows and
+// resets the counter/set/timer state for the next window. Gauges are left
+// in place, matching statsd semantics where a gauge holds its last value
+// until it's set again.
+func (a *StatsdAggregator) flushRows() []flushRow {
+	var rows []flushRow
+
+	for _, ctr := range a.counters {
+		rows = append(rows, flushRow{ctr.metric, ctr.sum, ctr.tags})
+	}
+	a.counters = make(map[string]*counterAgg)
+
+	for _, g := range a.gauges {
+		rows = append(rows, flushRow{g.metric, g.value, g.tags})
+	}
+
+	for _, set := range a.sets {
+		rows = append(rows, flushRow{set.metric, float64(len(set.values)), set.tags})
+	}
+	a.sets = make(map[string]*setAgg)
+
+	for _, t := range a.timers {
+		count := float64(t.count)
+		rows = append(rows,
+			flushRow{t.metric + ".count", count, t.tags},
+			flushRow{t.metric + ".min", t.min, t.tags},
+			flushRow{t.metric + ".max", t.max, t.tags},
+			flushRow{t.metric + ".sum", t.sum, t.tags},
+			flushRow{t.metric + ".mean", t.sum / count, t.tags},
+		)
+		for _, p := range a.config.Percentiles {
+			suffix := percentileSuffix(p)
+			if p == 0.5 {
+				suffix = ".median"
+			}
+			rows = append(rows, flushRow{t.metric + suffix, t.stream.Query(p), t.tags})
+		}
+		rows = append(rows,
+			flushRow{t.metric + ".upper", t.max, t.tags},
+			flushRow{t.metric + ".lower", t.min, t.tags},
+		)
+	}
+	a.timers = make(map[string]*timerAgg)
+
+	return rows
+}
+
+func (a *StatsdAggregator) flush(fr FilterRunner) {
+	for _, row := range a.flushRows() {
+		a.inject(fr, row.metric, row.value, row.tags)
+	}
+}
+
+func (a *StatsdAggregator) inject(fr FilterRunner, metric string, value float64,
+	tags map[string]interface{}) {
+
+	pack, err := a.helper.PipelinePack(0)
+	if err != nil || pack == nil {
+		fr.LogError(fmt.Errorf("unable to get a PipelinePack for aggregated metric '%s': %s", metric, err))
+		return
+	}
+
+	if err := a.addStatField(pack, "Metric", metric); err != nil {
+		fr.LogError(err)
+		return
+	}
+	if err := a.addStatField(pack, "Value", value); err != nil {
+		fr.LogError(err)
+		return
+	}
+	for k, v := range tags {
+		if err := a.addStatField(pack, a.config.TagNamePrefix+k, v); err != nil {
+			fr.LogError(err)
+			return
+		}
+	}
+
+	pack.Message.SetType("statsd")
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	fr.Inject(pack)
+}
+
+func (a *StatsdAggregator) addStatField(pack *PipelinePack, name string,
+	value interface{}) error {
+
+	field, err := message.NewField(name, value, "")
+	if err != nil {
+		return fmt.Errorf("error adding field '%s': %s", name, err)
+	}
+	pack.Message.AddField(field)
+	return nil
+}
+
+func init() {
+	RegisterPlugin("StatsdAggregator", func() interface{} {
+		return new(StatsdAggregator)
+	})
+}
@@ -0,0 +1,226 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Kieren Hynd <kieren@ticketmaster.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package statsd
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"testing"
+)
+
+func newStatPack(metric string, value float64, modifier string, sampling float64,
+	tags map[string]string) *pipeline.PipelinePack {
+
+	pack := &pipeline.PipelinePack{Message: new(message.Message)}
+
+	addField := func(name string, value interface{}) {
+		field, err := message.NewField(name, value, "")
+		if err != nil {
+			panic(err)
+		}
+		pack.Message.AddField(field)
+	}
+
+	addField("Metric", metric)
+	addField("Value", value)
+	addField("Modifier", modifier)
+	addField("Sampling", sampling)
+	for k, v := range tags {
+		addField("tag_"+k, v)
+	}
+
+	return pack
+}
+
+func newTestAggregator(percentiles []float64) *StatsdAggregator {
+	a := &StatsdAggregator{config: &StatsdAggregatorConfig{
+		TagNamePrefix:   "tag_",
+		Percentiles:     percentiles,
+		QuantileEpsilon: 0.01,
+	}}
+	a.counters = make(map[string]*counterAgg)
+	a.gauges = make(map[string]*gaugeAgg)
+	a.sets = make(map[string]*setAgg)
+	a.timers = make(map[string]*timerAgg)
+	return a
+}
+
+func rowFor(rows []flushRow, metric string) (flushRow, bool) {
+	for _, r := range rows {
+		if r.metric == metric {
+			return r, true
+		}
+	}
+	return flushRow{}, false
+}
+
+func TestAccumulateCounterSumsAndDividesBySamplingRate(t *testing.T) {
+	a := newTestAggregator(nil)
+	a.accumulate(newStatPack("gorets", 1, "c", 1.0, nil))
+	a.accumulate(newStatPack("gorets", 1, "c", 0.1, nil))
+
+	k := a.key("gorets", map[string]interface{}{})
+	ctr, ok := a.counters[k]
+	if !ok {
+		t.Fatalf("expected a counter aggregation for %q", k)
+	}
+	if want := 1.0 + 1.0/0.1; ctr.sum != want {
+		t.Errorf("counter sum = %v, want %v", ctr.sum, want)
+	}
+}
+
+func TestAccumulateGaugeKeepsLastValue(t *testing.T) {
+	a := newTestAggregator(nil)
+	a.accumulate(newStatPack("temp", 10, "g", 1.0, nil))
+	a.accumulate(newStatPack("temp", 20, "g", 1.0, nil))
+
+	k := a.key("temp", map[string]interface{}{})
+	g, ok := a.gauges[k]
+	if !ok {
+		t.Fatalf("expected a gauge aggregation for %q", k)
+	}
+	if g.value != 20 {
+		t.Errorf("gauge value = %v, want 20 (last value wins)", g.value)
+	}
+}
+
+func TestAccumulateSetCountsDistinctValues(t *testing.T) {
+	a := newTestAggregator(nil)
+	a.accumulate(newStatPack("uniques", 1, "s", 1.0, nil))
+	a.accumulate(newStatPack("uniques", 2, "s", 1.0, nil))
+	a.accumulate(newStatPack("uniques", 1, "s", 1.0, nil))
+
+	k := a.key("uniques", map[string]interface{}{})
+	set, ok := a.sets[k]
+	if !ok {
+		t.Fatalf("expected a set aggregation for %q", k)
+	}
+	if len(set.values) != 2 {
+		t.Errorf("set cardinality = %d, want 2", len(set.values))
+	}
+}
+
+func TestAccumulateGroupsByTagset(t *testing.T) {
+	a := newTestAggregator(nil)
+	a.accumulate(newStatPack("hits", 1, "c", 1.0, map[string]string{"host": "a"}))
+	a.accumulate(newStatPack("hits", 1, "c", 1.0, map[string]string{"host": "b"}))
+
+	if len(a.counters) != 2 {
+		t.Errorf("expected distinct tagsets to produce separate counters, got %d", len(a.counters))
+	}
+}
+
+func TestFlushRowsTimerStats(t *testing.T) {
+	a := newTestAggregator([]float64{0.5})
+	for _, v := range []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10} {
+		a.accumulate(newStatPack("latency", v, "ms", 1.0, nil))
+	}
+
+	rows := a.flushRows()
+
+	count, ok := rowFor(rows, "latency.count")
+	if !ok || count.value != 10 {
+		t.Errorf("latency.count = %+v, want value 10", count)
+	}
+	min, ok := rowFor(rows, "latency.min")
+	if !ok || min.value != 1 {
+		t.Errorf("latency.min = %+v, want value 1", min)
+	}
+	max, ok := rowFor(rows, "latency.max")
+	if !ok || max.value != 10 {
+		t.Errorf("latency.max = %+v, want value 10", max)
+	}
+	sum, ok := rowFor(rows, "latency.sum")
+	if !ok || sum.value != 55 {
+		t.Errorf("latency.sum = %+v, want value 55", sum)
+	}
+	mean, ok := rowFor(rows, "latency.mean")
+	if !ok || mean.value != 5.5 {
+		t.Errorf("latency.mean = %+v, want value 5.5", mean)
+	}
+	if _, ok := rowFor(rows, "latency.median"); !ok {
+		t.Errorf("expected a latency.median row for the p0.5 percentile")
+	}
+	if _, ok := rowFor(rows, "latency.upper"); !ok {
+		t.Errorf("expected a latency.upper row")
+	}
+	if _, ok := rowFor(rows, "latency.lower"); !ok {
+		t.Errorf("expected a latency.lower row")
+	}
+}
+
+func TestFlushRowsResetsCountersSetsAndTimersButKeepsGauges(t *testing.T) {
+	a := newTestAggregator([]float64{0.5})
+	a.accumulate(newStatPack("gorets", 1, "c", 1.0, nil))
+	a.accumulate(newStatPack("uniques", 1, "s", 1.0, nil))
+	a.accumulate(newStatPack("latency", 1, "ms", 1.0, nil))
+	a.accumulate(newStatPack("temp", 10, "g", 1.0, nil))
+
+	a.flushRows()
+
+	if len(a.counters) != 0 {
+		t.Errorf("expected counters to be reset after flush, got %d", len(a.counters))
+	}
+	if len(a.sets) != 0 {
+		t.Errorf("expected sets to be reset after flush, got %d", len(a.sets))
+	}
+	if len(a.timers) != 0 {
+		t.Errorf("expected timers to be reset after flush, got %d", len(a.timers))
+	}
+	if len(a.gauges) != 1 {
+		t.Errorf("expected gauges to survive a flush (last value wins), got %d", len(a.gauges))
+	}
+}
+
+func TestPercentileSuffix(t *testing.T) {
+	cases := []struct {
+		p    float64
+		want string
+	}{
+		{0.9, ".p90"},
+		{0.95, ".p95"},
+		{0.99, ".p99"},
+		{0.999, ".p999"},
+	}
+	for _, c := range cases {
+		if got := percentileSuffix(c.p); got != c.want {
+			t.Errorf("percentileSuffix(%v) = %q, want %q", c.p, got, c.want)
+		}
+	}
+
+	if s99, s999 := percentileSuffix(0.99), percentileSuffix(0.999); s99 == s999 {
+		t.Errorf("p99 and p999 must not collide, both rendered as %q", s99)
+	}
+}
+
+func TestAggregatorKeyGroupsByMetricAndTagset(t *testing.T) {
+	a := &StatsdAggregator{}
+
+	k1 := a.key("foo", map[string]interface{}{"host": "a", "env": "prod"})
+	k2 := a.key("foo", map[string]interface{}{"env": "prod", "host": "a"})
+	if k1 != k2 {
+		t.Errorf("key() must be stable regardless of tag iteration order: %q != %q", k1, k2)
+	}
+
+	k3 := a.key("foo", map[string]interface{}{"host": "b", "env": "prod"})
+	if k1 == k3 {
+		t.Errorf("key() must differ for distinct tag sets, got %q for both", k1)
+	}
+
+	k4 := a.key("bar", map[string]interface{}{"host": "a", "env": "prod"})
+	if k1 == k4 {
+		t.Errorf("key() must differ for distinct metrics, got %q for both", k1)
+	}
+}